@@ -0,0 +1,89 @@
+// Package leader tracks which single replicator is allowed to publish
+// for a given topic when several replicators consume the same source
+// subject, so that sharing last-seen state between them (see the limiter
+// package) is not undone by every replica publishing independently.
+package leader
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Backend runs the actual election for a single topic. The default
+// backend, natskv.Backend, uses a JetStream KV bucket; other backends
+// (Consul, etcd, ...) can be added by implementing this interface.
+type Backend interface {
+	// Campaign runs the election loop for topic until ctx is cancelled,
+	// calling onChange whenever this node's leadership of topic changes.
+	// fencing is a token that increases every time leadership changes
+	// hands, so a publisher can stamp it into outgoing messages and a
+	// zombie leader's stale writes can be detected and rejected
+	// downstream.
+	Campaign(ctx context.Context, wg *sync.WaitGroup, topic string, onChange func(isLeader bool, fencing uint64)) error
+}
+
+var leaderGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "stream_replicator_limiter_leader",
+	Help: "Whether this instance is currently the elected leader for a topic, 1 for leader 0 for standby",
+}, []string{"topic"})
+
+func init() {
+	prometheus.MustRegister(leaderGauge)
+}
+
+// Elector tracks this instance's leadership of a topic using a pluggable
+// Backend, exposing the current state so other packages can gate on it
+type Elector struct {
+	backend Backend
+	topic   string
+
+	mu       sync.RWMutex
+	isLeader bool
+	fencing  uint64
+}
+
+// New creates an Elector that campaigns for leadership using backend
+func New(backend Backend) *Elector {
+	return &Elector{backend: backend}
+}
+
+// Run campaigns for leadership of topic until ctx is cancelled
+func (e *Elector) Run(ctx context.Context, wg *sync.WaitGroup, topic string) error {
+	e.topic = topic
+
+	return e.backend.Campaign(ctx, wg, topic, e.update)
+}
+
+func (e *Elector) update(isLeader bool, fencing uint64) {
+	e.mu.Lock()
+	e.isLeader = isLeader
+	e.fencing = fencing
+	e.mu.Unlock()
+
+	g := 0.0
+	if isLeader {
+		g = 1.0
+	}
+	leaderGauge.WithLabelValues(e.topic).Set(g)
+}
+
+// IsLeader reports whether this instance currently holds leadership of
+// its topic
+func (e *Elector) IsLeader() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.isLeader
+}
+
+// FencingToken returns the current fencing token, a publisher should
+// stamp this into outgoing messages so downstream consumers can reject
+// writes from a leader that has since lost and not yet noticed
+func (e *Elector) FencingToken() uint64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.fencing
+}
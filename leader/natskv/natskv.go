@@ -0,0 +1,184 @@
+// Package natskv implements leader.Backend using a NATS JetStream KV
+// bucket: one key per topic, holding the current leader's id and fencing
+// token behind a short TTL that the leader must keep renewing.
+package natskv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/choria-io/stream-replicator/config"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// bucket is the JetStream KV bucket holding leader keys, one per topic
+const bucket = "SR_LIMITER_LEADERS"
+
+// leaseTTL is how long a leadership claim is valid without renewal
+const leaseTTL = 10 * time.Second
+
+// renewInterval is how often the leader renews its lease, comfortably
+// inside leaseTTL so a single missed renewal does not cost leadership
+const renewInterval = 3 * time.Second
+
+type lease struct {
+	ID      string `json:"id"`
+	Fencing uint64 `json:"fencing"`
+}
+
+// kvStore is the subset of nats.KeyValue the election state machine
+// needs, narrowed so it can be driven by a fake in tests without a
+// running NATS server
+type kvStore interface {
+	Get(key string) (nats.KeyValueEntry, error)
+	Create(key string, value []byte) (uint64, error)
+	Update(key string, value []byte, last uint64) (uint64, error)
+}
+
+// Backend is a leader.Backend backed by a NATS JetStream KV bucket
+type Backend struct {
+	id  string
+	log *logrus.Entry
+}
+
+// New creates a Backend with a fresh random node id. It does not connect
+// to NATS; Campaign does, using the repository's standard connection
+// configuration
+func New() *Backend {
+	return &Backend{
+		id:  uuid.New().String(),
+		log: logrus.WithFields(logrus.Fields{"component": "leader/natskv"}),
+	}
+}
+
+func (b *Backend) Campaign(ctx context.Context, wg *sync.WaitGroup, topic string, onChange func(isLeader bool, fencing uint64)) error {
+	nc, err := nats.Connect(config.NatsServers(), nats.Name(fmt.Sprintf("stream-replicator-leader-%s", b.id)))
+	if err != nil {
+		return fmt.Errorf("could not connect to nats for leader election: %s", err)
+	}
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("could not get jetstream context: %s", err)
+	}
+
+	kv, err := js.KeyValue(bucket)
+	if err != nil {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: bucket, TTL: leaseTTL})
+		if err != nil {
+			return fmt.Errorf("could not create leader bucket: %s", err)
+		}
+	}
+
+	wg.Add(1)
+	go b.run(ctx, wg, kv, topic, onChange)
+
+	return nil
+}
+
+func (b *Backend) run(ctx context.Context, wg *sync.WaitGroup, kv kvStore, topic string, onChange func(isLeader bool, fencing uint64)) {
+	defer wg.Done()
+
+	isLeader := false
+	var fencing uint64
+	backoff := time.Second
+
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+
+	attempt := func() {
+		won, newFencing, err := b.tryAcquire(kv, topic, fencing)
+		if err != nil {
+			b.log.Warnf("Could not campaign for leadership of %s: %s", topic, err)
+
+			if isLeader {
+				isLeader = false
+				onChange(false, fencing)
+			}
+
+			select {
+			case <-time.After(backoff + time.Duration(rand.Int63n(int64(backoff)))):
+			case <-ctx.Done():
+			}
+
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+
+			return
+		}
+
+		backoff = time.Second
+
+		if won != isLeader || newFencing != fencing {
+			isLeader = won
+			fencing = newFencing
+			onChange(isLeader, fencing)
+		}
+	}
+
+	attempt()
+
+	for {
+		select {
+		case <-ticker.C:
+			attempt()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// tryAcquire attempts to (re)claim leadership of topic, returning the
+// winning state and its fencing token. fencing is this node's own last
+// known token, only used to seed a brand new lease - the KV entry, when
+// one exists, is always authoritative: a node that still believes
+// itself leader after a couple of missed renewals must not be allowed
+// to overwrite another node's live lease, and any fencing token it
+// learns of must come from that live lease, never from its own
+// possibly stale state.
+func (b *Backend) tryAcquire(kv kvStore, topic string, fencing uint64) (bool, uint64, error) {
+	entry, err := kv.Get(topic)
+	if err != nil && err != nats.ErrKeyNotFound {
+		return false, fencing, err
+	}
+
+	if entry != nil {
+		var current lease
+		if err := json.Unmarshal(entry.Value(), &current); err != nil {
+			return false, fencing, err
+		}
+
+		if current.ID == b.id {
+			_, err := kv.Update(topic, entry.Value(), entry.Revision())
+			if err != nil {
+				return false, current.Fencing, err
+			}
+
+			return true, current.Fencing, nil
+		}
+
+		// Someone else holds a live lease - the KV wins over whatever
+		// this node last believed about its own leadership.
+		return false, current.Fencing, nil
+	}
+
+	newLease := lease{ID: b.id, Fencing: fencing + 1}
+	encoded, err := json.Marshal(newLease)
+	if err != nil {
+		return false, fencing, err
+	}
+
+	if _, err := kv.Create(topic, encoded); err != nil {
+		return false, fencing, err
+	}
+
+	return true, newLease.Fencing, nil
+}
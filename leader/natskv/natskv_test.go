@@ -0,0 +1,185 @@
+package natskv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+type fakeEntry struct {
+	value    []byte
+	revision uint64
+}
+
+func (e *fakeEntry) Bucket() string             { return bucket }
+func (e *fakeEntry) Key() string                { return "" }
+func (e *fakeEntry) Value() []byte              { return e.value }
+func (e *fakeEntry) Revision() uint64           { return e.revision }
+func (e *fakeEntry) Created() time.Time         { return time.Time{} }
+func (e *fakeEntry) Delta() uint64              { return 0 }
+func (e *fakeEntry) Operation() nats.KeyValueOp { return nats.KeyValuePut }
+
+// fakeKV is a minimal in-memory kvStore used to drive the election state
+// machine without a running NATS server
+type fakeKV struct {
+	entry     *fakeEntry
+	failWrite bool
+}
+
+func (f *fakeKV) Get(key string) (nats.KeyValueEntry, error) {
+	if f.entry == nil {
+		return nil, nats.ErrKeyNotFound
+	}
+	return f.entry, nil
+}
+
+func (f *fakeKV) Create(key string, value []byte) (uint64, error) {
+	if f.failWrite {
+		return 0, errors.New("simulated backend error")
+	}
+	if f.entry != nil {
+		return 0, errors.New("key already exists")
+	}
+	f.entry = &fakeEntry{value: value, revision: 1}
+	return f.entry.revision, nil
+}
+
+func (f *fakeKV) Update(key string, value []byte, last uint64) (uint64, error) {
+	if f.failWrite {
+		return 0, errors.New("simulated backend error")
+	}
+	if f.entry == nil || f.entry.revision != last {
+		return 0, errors.New("revision mismatch")
+	}
+	f.entry.value = value
+	f.entry.revision++
+	return f.entry.revision, nil
+}
+
+func leaseOf(t *testing.T, kv *fakeKV) lease {
+	t.Helper()
+
+	var l lease
+	if err := json.Unmarshal(kv.entry.value, &l); err != nil {
+		t.Fatalf("could not decode lease: %s", err)
+	}
+
+	return l
+}
+
+func TestTryAcquire_AcquiresWhenNoLease(t *testing.T) {
+	b := &Backend{id: "node-a"}
+	kv := &fakeKV{}
+
+	won, fencing, err := b.tryAcquire(kv, "topic", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !won {
+		t.Fatal("expected to win an empty lease")
+	}
+	if fencing != 1 {
+		t.Fatalf("expected fencing 1, got %d", fencing)
+	}
+}
+
+func TestTryAcquire_RenewsOwnLease(t *testing.T) {
+	b := &Backend{id: "node-a"}
+	kv := &fakeKV{}
+
+	won, fencing, err := b.tryAcquire(kv, "topic", 0)
+	if err != nil || !won {
+		t.Fatalf("setup acquire failed: won=%v err=%s", won, err)
+	}
+
+	won, fencing2, err := b.tryAcquire(kv, "topic", fencing)
+	if err != nil {
+		t.Fatalf("unexpected error on renewal: %s", err)
+	}
+	if !won {
+		t.Fatal("expected to keep leadership on renewal")
+	}
+	if fencing2 != fencing {
+		t.Fatalf("renewal must not change the fencing token: got %d want %d", fencing2, fencing)
+	}
+}
+
+// TestTryAcquire_RejectsZombieTakeover is a regression test: a node that
+// still locally believes it is leader after missed renewals must not be
+// able to steal the lease back from whoever the KV says currently holds
+// it, and must adopt that node's fencing token rather than its own.
+func TestTryAcquire_RejectsZombieTakeover(t *testing.T) {
+	zombie := &Backend{id: "zombie"}
+	other := &Backend{id: "new-leader"}
+	kv := &fakeKV{}
+
+	// "other" wins the lease first
+	if _, _, err := other.tryAcquire(kv, "topic", 0); err != nil {
+		t.Fatalf("setup acquire failed: %s", err)
+	}
+	currentLease := leaseOf(t, kv)
+
+	// the zombie still thinks it holds a high fencing token from before
+	won, fencing, err := zombie.tryAcquire(kv, "topic", 999)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if won {
+		t.Fatal("a node must not be able to take over another node's live lease")
+	}
+	if fencing != currentLease.Fencing {
+		t.Fatalf("expected the live lease's fencing token %d, got %d", currentLease.Fencing, fencing)
+	}
+
+	// and the lease in the KV must be untouched
+	stillCurrent := leaseOf(t, kv)
+	if stillCurrent.ID != other.id {
+		t.Fatalf("lease owner changed unexpectedly to %s", stillCurrent.ID)
+	}
+}
+
+// TestRun_StopsPromptlyDuringBackoff is a regression test: a node that
+// hits a run of failed tryAcquire calls must still observe context
+// cancellation while it is backing off, rather than blocking in a plain
+// time.Sleep until the backoff elapses - otherwise a graceful shutdown
+// during a backend outage can hang for up to the max backoff.
+func TestRun_StopsPromptlyDuringBackoff(t *testing.T) {
+	b := &Backend{id: "node-a", log: logrus.NewEntry(logrus.New())}
+	kv := &fakeKV{failWrite: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go b.run(ctx, &wg, kv, "topic", func(isLeader bool, fencing uint64) {})
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(300 * time.Millisecond):
+		t.Fatal("run did not stop promptly after ctx cancellation during backoff")
+	}
+}
+
+func TestTryAcquire_PropagatesBackendErrors(t *testing.T) {
+	b := &Backend{id: "node-a"}
+	kv := &fakeKV{failWrite: true}
+
+	_, _, err := b.tryAcquire(kv, "topic", 0)
+	if err == nil {
+		t.Fatal("expected a backend write error to be returned, not swallowed")
+	}
+}
@@ -0,0 +1,324 @@
+// Package distributed provides a limiter.Limiter backend that shares its
+// last-seen state across a fleet of replicators consuming the same source
+// topic, so that running N replicas does not re-deliver every unique key
+// once per replica.
+//
+// Each replicator embeds a coordinator that hashes the inspected value to
+// a peer authoritative for that key using a consistent hash ring built
+// from NATS peer heartbeats; the last-seen check for a key is performed
+// by its owning peer and reached over a NATS request/reply call. A short
+// lived local cache of the owning peer's "already seen" answers absorbs
+// repeat lookups for the same value for up to cacheTTL; it is not cleared
+// when the ring changes.
+package distributed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/choria-io/stream-replicator/config"
+	"github.com/choria-io/stream-replicator/limiter"
+	"github.com/google/uuid"
+	stan "github.com/nats-io/go-nats-streaming"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// cacheTTL bounds how long a cache-through decision learned from a peer
+// is trusted before the owning peer is asked again
+const cacheTTL = 2 * time.Second
+
+// requestTimeout bounds how long ProcessAndRecord waits for the owning
+// peer to answer before falling back to processing locally
+const requestTimeout = 250 * time.Millisecond
+
+// Limiter is a limiter.Limiter that coordinates last-seen state with
+// other replicators over NATS rather than keeping it purely in-process
+type Limiter struct {
+	id    string
+	key   string
+	age   time.Duration
+	topic string
+
+	nc      *nats.Conn
+	subject string
+
+	peers *peerSet
+	shard *shard
+
+	cache map[string]cacheEntry
+	cmu   sync.Mutex
+
+	log *logrus.Entry
+}
+
+type cacheEntry struct {
+	process bool
+	at      time.Time
+}
+
+type checkRequest struct {
+	Value string `json:"value"`
+}
+
+type checkResponse struct {
+	Process bool `json:"process"`
+}
+
+type commitRequest struct {
+	Value string `json:"value"`
+}
+
+var forwardedCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "stream_replicator_limiter_distributed_forwarded",
+	Help: "How many last-seen checks were forwarded to the owning peer",
+}, []string{"key", "name"})
+
+var timeoutCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "stream_replicator_limiter_distributed_timeouts",
+	Help: "How many last-seen checks timed out waiting for the owning peer",
+}, []string{"key", "name"})
+
+var shardSizeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "stream_replicator_limiter_distributed_shard_size",
+	Help: "How many unique values this peer is authoritative for",
+}, []string{"key", "name"})
+
+func init() {
+	prometheus.MustRegister(forwardedCtr)
+	prometheus.MustRegister(timeoutCtr)
+	prometheus.MustRegister(shardSizeGauge)
+}
+
+var _ limiter.Limiter = &Limiter{}
+
+func (d *Limiter) Configure(ctx context.Context, wg *sync.WaitGroup, key string, age time.Duration, topic string) error {
+	d.id = uuid.New().String()
+	d.key = key
+	d.age = age
+	d.topic = topic
+	d.subject = fmt.Sprintf("sr.limiter.%s", topic)
+	d.cache = make(map[string]cacheEntry)
+	d.log = logrus.WithFields(logrus.Fields{"key": key, "age": age, "topic": topic, "id": d.id})
+
+	nc, err := nats.Connect(config.NatsServers(), nats.Name(fmt.Sprintf("stream-replicator-limiter-%s", d.id)))
+	if err != nil {
+		return fmt.Errorf("could not connect to nats for distributed limiter coordination: %s", err)
+	}
+	d.nc = nc
+
+	d.peers = newPeerSet(d.log)
+	d.shard = newShard(age)
+
+	sub, err := nc.Subscribe(d.subject+".shard."+d.id, d.handleRequest)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to shard subject: %s", err)
+	}
+
+	commitSub, err := nc.Subscribe(d.subject+".commit."+d.id, d.handleCommit)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to commit subject: %s", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		sub.Unsubscribe()
+		commitSub.Unsubscribe()
+	}()
+
+	wg.Add(1)
+	go d.peers.announce(ctx, wg, nc, d.subject+".peers", d.id)
+
+	wg.Add(1)
+	go d.scrubber(ctx, wg)
+
+	wg.Add(1)
+	go d.promUpdater(ctx, wg)
+
+	return nil
+}
+
+func (d *Limiter) ProcessAndRecord(msg *stan.Msg, f func(msg *stan.Msg, process bool) error) error {
+	process := d.Decide(msg)
+
+	err := f(msg, process)
+	if err != nil {
+		return err
+	}
+
+	if process {
+		d.Record(msg)
+	}
+
+	return nil
+}
+
+// Decide reports whether msg should be processed, without recording
+// anything - callers that use it directly must call Record themselves
+// once the processing it allowed through has actually succeeded
+func (d *Limiter) Decide(msg *stan.Msg) bool {
+	if d.key == "" {
+		return true
+	}
+
+	value := gjson.GetBytes(msg.Data, d.key).String()
+	if value == "" {
+		return true
+	}
+
+	return d.shouldProcess(value)
+}
+
+// Record marks msg's tracked value as seen with its owning peer
+func (d *Limiter) Record(msg *stan.Msg) {
+	if d.key == "" {
+		return
+	}
+
+	value := gjson.GetBytes(msg.Data, d.key).String()
+	if value == "" {
+		return
+	}
+
+	d.commit(value)
+}
+
+// shouldProcess determines who owns value and either checks the local
+// shard directly or reaches the owning peer over NATS, falling back to
+// "process=true" on timeout so availability is preferred over strictness
+func (d *Limiter) shouldProcess(value string) bool {
+	owner := d.peers.ring.Owner(value)
+
+	if owner == "" || owner == d.id {
+		return d.shard.checkAndReserve(value)
+	}
+
+	if process, found := d.cachedDecision(value); found {
+		return process
+	}
+
+	forwardedCtr.WithLabelValues(d.key, d.topic).Inc()
+
+	req, _ := json.Marshal(checkRequest{Value: value})
+	reply, err := d.nc.Request(d.subject+".shard."+owner, req, requestTimeout)
+	if err != nil {
+		timeoutCtr.WithLabelValues(d.key, d.topic).Inc()
+		d.log.Warnf("Timed out checking %s=%s with peer %s, processing locally: %s", d.key, value, owner, err)
+		return true
+	}
+
+	var resp checkResponse
+	if err := json.Unmarshal(reply.Data, &resp); err != nil {
+		d.log.Errorf("Could not decode response from peer %s: %s", owner, err)
+		return true
+	}
+
+	// Only "already seen" answers are cached: a positive answer is not yet
+	// committed by the owner, so caching it would let repeats of the same
+	// value through until the entry expired.
+	if !resp.Process {
+		d.cacheDecision(value, false)
+	}
+
+	return resp.Process
+}
+
+func (d *Limiter) commit(value string) {
+	owner := d.peers.ring.Owner(value)
+
+	if owner == "" || owner == d.id {
+		d.shard.commit(value)
+		return
+	}
+
+	req, _ := json.Marshal(commitRequest{Value: value})
+	if err := d.nc.Publish(d.subject+".commit."+owner, req); err != nil {
+		d.log.Errorf("Could not publish commit for %s=%s to peer %s: %s", d.key, value, owner, err)
+	}
+}
+
+func (d *Limiter) cachedDecision(value string) (bool, bool) {
+	d.cmu.Lock()
+	defer d.cmu.Unlock()
+
+	e, found := d.cache[value]
+	if !found || e.at.Before(time.Now().Add(-1*cacheTTL)) {
+		return false, false
+	}
+
+	return e.process, true
+}
+
+func (d *Limiter) cacheDecision(value string, process bool) {
+	d.cmu.Lock()
+	d.cache[value] = cacheEntry{process: process, at: time.Now()}
+	d.cmu.Unlock()
+}
+
+func (d *Limiter) handleRequest(msg *nats.Msg) {
+	var req checkRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		d.log.Errorf("Could not decode check request: %s", err)
+		return
+	}
+
+	process := d.shard.checkAndReserve(req.Value)
+
+	resp, _ := json.Marshal(checkResponse{Process: process})
+	if err := d.nc.Publish(msg.Reply, resp); err != nil {
+		d.log.Errorf("Could not reply to check request: %s", err)
+	}
+}
+
+func (d *Limiter) handleCommit(msg *nats.Msg) {
+	var req commitRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		d.log.Errorf("Could not decode commit request: %s", err)
+		return
+	}
+
+	d.shard.commit(req.Value)
+}
+
+func (d *Limiter) scrubber(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.shard.scrub()
+			d.shard.rehome(func(value string) bool {
+				owner := d.peers.ring.Owner(value)
+				return owner == "" || owner == d.id
+			})
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *Limiter) promUpdater(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			shardSizeGauge.WithLabelValues(d.key, d.topic).Set(float64(d.shard.size()))
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package distributed
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestLimiter(age time.Duration) *Limiter {
+	return &Limiter{
+		id:    "self",
+		key:   "value",
+		age:   age,
+		topic: "topic",
+		peers: newPeerSet(logrus.NewEntry(logrus.New())),
+		shard: newShard(age),
+		cache: make(map[string]cacheEntry),
+		log:   logrus.NewEntry(logrus.New()),
+	}
+}
+
+// TestLimiter_ShouldProcessUsesLocalShardWhenSelfOwns is a regression test
+// for the single-replicator case: with no other peers announced, the ring
+// has no members and shouldProcess must handle the value against the
+// local shard directly rather than forwarding to a non-existent owner.
+func TestLimiter_ShouldProcessUsesLocalShardWhenSelfOwns(t *testing.T) {
+	d := newTestLimiter(time.Hour)
+
+	if !d.shouldProcess("sender-1") {
+		t.Fatal("expected the first sighting of a value to be allowed")
+	}
+
+	d.commit("sender-1")
+
+	if d.shouldProcess("sender-1") {
+		t.Fatal("expected a recently committed value to be blocked when handled locally")
+	}
+}
+
+func TestLimiter_ShouldProcessHandlesLocallyWhenRingOwnsSelf(t *testing.T) {
+	d := newTestLimiter(time.Hour)
+	d.peers.touch(d.id)
+
+	if !d.shouldProcess("sender-1") {
+		t.Fatal("expected the first sighting of a value to be allowed")
+	}
+
+	d.commit("sender-1")
+
+	if d.shouldProcess("sender-1") {
+		t.Fatal("expected a recently committed value to be blocked when self owns the ring")
+	}
+}
+
+func TestLimiter_CacheDecisionExpiresAfterTTL(t *testing.T) {
+	d := newTestLimiter(time.Hour)
+
+	d.cacheDecision("sender-1", false)
+	d.cmu.Lock()
+	e := d.cache["sender-1"]
+	e.at = time.Now().Add(-2 * cacheTTL)
+	d.cache["sender-1"] = e
+	d.cmu.Unlock()
+
+	if _, found := d.cachedDecision("sender-1"); found {
+		t.Fatal("expected a cached decision older than cacheTTL to be treated as not found")
+	}
+}
@@ -0,0 +1,112 @@
+package distributed
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/choria-io/stream-replicator/ring"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// peerTimeout is how long since the last heartbeat a peer is still
+// considered a member of the ring
+const peerTimeout = 15 * time.Second
+
+const heartbeatInterval = 5 * time.Second
+
+// peerSet tracks the other replicators sharing this topic's dedup window,
+// learned via periodic heartbeats on a topic scoped NATS subject
+type peerSet struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+	ring     *ring.Ring
+	log      *logrus.Entry
+}
+
+func newPeerSet(log *logrus.Entry) *peerSet {
+	return &peerSet{
+		lastSeen: make(map[string]time.Time),
+		ring:     ring.New(),
+		log:      log,
+	}
+}
+
+func (p *peerSet) touch(id string) {
+	p.mu.Lock()
+	_, known := p.lastSeen[id]
+	p.lastSeen[id] = time.Now()
+	p.mu.Unlock()
+
+	if !known {
+		p.rebuild()
+	}
+}
+
+func (p *peerSet) expire() {
+	p.mu.Lock()
+	killtime := time.Now().Add(-1 * peerTimeout)
+	changed := false
+	for id, t := range p.lastSeen {
+		if t.Before(killtime) {
+			delete(p.lastSeen, id)
+			changed = true
+		}
+	}
+	p.mu.Unlock()
+
+	if changed {
+		p.rebuild()
+	}
+}
+
+func (p *peerSet) rebuild() {
+	p.mu.Lock()
+	members := make([]string, 0, len(p.lastSeen))
+	for id := range p.lastSeen {
+		members = append(members, id)
+	}
+	p.mu.Unlock()
+
+	p.log.Debugf("Rebuilding peer ring with %d members: %v", len(members), members)
+	p.ring.Set(members)
+}
+
+// announce runs the heartbeat publish/subscribe loop for the peer set,
+// keeping the local ring in sync with who else is alive on this topic
+func (p *peerSet) announce(ctx context.Context, wg *sync.WaitGroup, nc *nats.Conn, subject string, self string) {
+	defer wg.Done()
+
+	sub, err := nc.Subscribe(subject, func(msg *nats.Msg) {
+		p.touch(string(msg.Data))
+	})
+	if err != nil {
+		p.log.Errorf("Could not subscribe to peer subject %s: %s", subject, err)
+		return
+	}
+	defer sub.Unsubscribe()
+
+	p.touch(self)
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	expiry := time.NewTicker(peerTimeout)
+	defer expiry.Stop()
+
+	for {
+		select {
+		case <-heartbeat.C:
+			if err := nc.Publish(subject, []byte(self)); err != nil {
+				p.log.Errorf("Could not publish peer heartbeat: %s", err)
+			}
+
+		case <-expiry.C:
+			p.expire()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package distributed
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestPeerSet() *peerSet {
+	return newPeerSet(logrus.NewEntry(logrus.New()))
+}
+
+func TestPeerSet_TouchAddsMemberToRing(t *testing.T) {
+	p := newTestPeerSet()
+
+	p.touch("peer-a")
+
+	if owner := p.ring.Owner("anything"); owner != "peer-a" {
+		t.Fatalf("expected the only known peer to own everything, got %q", owner)
+	}
+}
+
+func TestPeerSet_TouchOfKnownPeerDoesNotRebuildRing(t *testing.T) {
+	p := newTestPeerSet()
+
+	p.touch("peer-a")
+	p.ring.Set(nil) // simulate the ring having been cleared independently
+
+	p.touch("peer-a")
+
+	if owner := p.ring.Owner("anything"); owner != "" {
+		t.Fatal("expected re-touching an already known peer not to rebuild the ring")
+	}
+}
+
+func TestPeerSet_ExpireDropsStalePeers(t *testing.T) {
+	p := newTestPeerSet()
+
+	p.touch("peer-a")
+	p.mu.Lock()
+	p.lastSeen["peer-a"] = time.Now().Add(-2 * peerTimeout)
+	p.mu.Unlock()
+
+	p.touch("peer-b")
+	p.expire()
+
+	if owner := p.ring.Owner("anything"); owner != "peer-b" {
+		t.Fatalf("expected the stale peer to be removed from the ring, owner is %q", owner)
+	}
+}
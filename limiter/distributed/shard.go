@@ -0,0 +1,79 @@
+package distributed
+
+import (
+	"sync"
+	"time"
+)
+
+// shard holds the last-seen state this peer is authoritative for. It is
+// re-homed as peers join and leave the ring, so unlike memory.LocalLimiter
+// it carries no persistence of its own - losing a peer simply means its
+// keys are forgotten and re-learned by whichever peer inherits them.
+type shard struct {
+	age  time.Duration
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newShard(age time.Duration) *shard {
+	return &shard{
+		age:  age,
+		seen: make(map[string]time.Time),
+	}
+}
+
+// checkAndReserve reports whether value should be processed without yet
+// marking it as seen - the caller only commits the reservation once the
+// processing callback has succeeded, see commit()
+func (s *shard) checkAndReserve(value string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, found := s.seen[value]
+	if !found {
+		return true
+	}
+
+	return t.Before(time.Now().Add(-1 * s.age))
+}
+
+// commit records value as seen, called once the processing callback for
+// a message that was allowed through has succeeded
+func (s *shard) commit(value string) {
+	s.mu.Lock()
+	s.seen[value] = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *shard) scrub() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	killtime := time.Now().Add((-1 * s.age) - (10 * time.Minute))
+
+	for i, t := range s.seen {
+		if t.Before(killtime) {
+			delete(s.seen, i)
+		}
+	}
+}
+
+func (s *shard) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.seen)
+}
+
+// rehome drops any owned keys no longer hashing to self; the dropped keys
+// are not returned or forwarded to their new owner
+func (s *shard) rehome(owner func(value string) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for value := range s.seen {
+		if !owner(value) {
+			delete(s.seen, value)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package distributed
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShard_CheckAndReserveAllowsUnseenValue(t *testing.T) {
+	s := newShard(time.Hour)
+
+	if !s.checkAndReserve("a") {
+		t.Fatal("expected an unseen value to be allowed")
+	}
+}
+
+func TestShard_CheckAndReserveDoesNotCommit(t *testing.T) {
+	s := newShard(time.Hour)
+
+	s.checkAndReserve("a")
+	if !s.checkAndReserve("a") {
+		t.Fatal("checkAndReserve must not itself mark a value as seen - only commit does")
+	}
+}
+
+func TestShard_CommitBlocksWithinAge(t *testing.T) {
+	s := newShard(time.Hour)
+
+	s.commit("a")
+	if s.checkAndReserve("a") {
+		t.Fatal("expected a recently committed value to be blocked")
+	}
+}
+
+func TestShard_CommitAllowsAfterAgeElapses(t *testing.T) {
+	s := newShard(-1 * time.Second)
+
+	s.commit("a")
+	if !s.checkAndReserve("a") {
+		t.Fatal("expected a value committed longer ago than age to be allowed again")
+	}
+}
+
+func TestShard_ScrubRemovesOnlyExpiredEntries(t *testing.T) {
+	s := newShard(time.Hour)
+
+	s.seen["stale"] = time.Now().Add(-2 * time.Hour)
+	s.seen["fresh"] = time.Now()
+
+	s.scrub()
+
+	if _, found := s.seen["stale"]; found {
+		t.Fatal("expected scrub to remove an entry well past age plus the grace window")
+	}
+	if _, found := s.seen["fresh"]; !found {
+		t.Fatal("scrub must not remove a recently seen entry")
+	}
+}
+
+func TestShard_RehomeDropsKeysNoLongerOwned(t *testing.T) {
+	s := newShard(time.Hour)
+
+	s.commit("mine")
+	s.commit("theirs")
+
+	s.rehome(func(value string) bool {
+		return value == "mine"
+	})
+
+	if s.size() != 1 {
+		t.Fatalf("expected rehome to drop keys no longer owned, got size %d", s.size())
+	}
+	if !s.checkAndReserve("theirs") {
+		t.Fatal("a rehomed-away key must be forgotten, not just hidden")
+	}
+}
@@ -0,0 +1,39 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	stan "github.com/nats-io/go-nats-streaming"
+)
+
+// Limiter inspects data being processed, tracks a certain key and ensures
+// a processor function only runs once per age per unique tracked key.
+//
+// The canonical implementation, memory.LocalLimiter, keeps this state in
+// the local process; distributed.Limiter shares it across a fleet of
+// replicators consuming the same source topic.
+type Limiter interface {
+	// Configure prepares the limiter for use. It should start any
+	// background goroutines it needs against ctx and register them
+	// with wg so callers can wait for a clean shutdown.
+	Configure(ctx context.Context, wg *sync.WaitGroup, key string, age time.Duration, topic string) error
+
+	// ProcessAndRecord inspects msg, decides whether it should be processed
+	// based on the configured key and age, invokes f with that decision and,
+	// when f succeeds and the message was processed, records the key as seen.
+	// It is implemented in terms of Decide and Record, callers that need to
+	// retry the processing step without repeating the decision - such as
+	// publisher.QueueManager - should call those directly instead.
+	ProcessAndRecord(msg *stan.Msg, f func(msg *stan.Msg, process bool) error) error
+
+	// Decide reports whether msg should be processed, based on the
+	// configured key and age, without recording anything
+	Decide(msg *stan.Msg) bool
+
+	// Record marks msg's tracked value as seen. Callers using Decide
+	// directly must only call Record once whatever processing Decide
+	// allowed through has actually succeeded.
+	Record(msg *stan.Msg)
+}
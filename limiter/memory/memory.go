@@ -2,36 +2,65 @@ package memory
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
+	"math/rand"
 	"sync"
 	"time"
 
 	"github.com/choria-io/stream-replicator/config"
+	"github.com/choria-io/stream-replicator/limiter"
+	"github.com/choria-io/stream-replicator/statestore"
 	stan "github.com/nats-io/go-nats-streaming"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/tidwall/gjson"
 )
 
-// Limiter is a in-process memory based state tracker that inspects
+// saveInterval is how often the dirty entries accumulated since the last
+// save are flushed to the backend
+const saveInterval = 30 * time.Second
+
+// maxSaveBackoff bounds the exponential backoff applied to retries of a
+// failed save, so a backend outage does not silently grow unbounded
+const maxSaveBackoff = 5 * time.Minute
+
+// compactInterval is how often the full scrubbed cache is written back to
+// the backend as a complete Save, rather than an incremental delta.
+// SaveIncremental only ever merges keys in, so without this the expired
+// entries scrub() removes from m.seen would never be removed from the
+// backend and it would grow without bound.
+const compactInterval = 10 * time.Minute
+
+// LocalLimiter is a in-process memory based state tracker that inspects
 // data being processed, tracks a certain key and ensure a processor
 // function is only run once per age per unique tracked key
 //
-// It can save the cache to disk regularly if configured and load
-// it during startup which helps on very large sender counts to
-// drastically reduce the restart costs of this kind of cache
-type Limiter struct {
-	key       string
-	age       time.Duration
-	topic     string
-	statefile string
-	seen      map[string]time.Time
-	mu        *sync.Mutex
-	log       *logrus.Entry
+// It can save the cache to a statestore.Backend regularly if configured
+// and load it during startup which helps on very large sender counts to
+// drastically reduce the restart costs of this kind of cache. A regular
+// save writes only the entries that changed since the last save, see
+// dirty; every compactInterval the full cache is written instead.
+//
+// It implements limiter.Limiter and is the default limiter backend; it
+// does not share state with other replicators, see distributed.Limiter
+// for a backend that does.
+type LocalLimiter struct {
+	key     string
+	age     time.Duration
+	topic   string
+	backend statestore.Backend
+	seen    map[string]time.Time
+	dirty   map[string]time.Time
+	mu      *sync.Mutex
+	log     *logrus.Entry
+
+	// ioMu serializes save (an incremental SaveIncremental of the dirty
+	// set) against compact (a full Save of the scrubbed cache) so one can
+	// never land after the other touched a newer value - without this a
+	// compact that snapshotted m.seen before a concurrent Record, but
+	// whose Save call reaches the backend after that Record's
+	// SaveIncremental already did, would silently revert the backend to
+	// the older state.
+	ioMu sync.Mutex
 }
 
 var seenGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
@@ -54,42 +83,80 @@ var errCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Help: "How many errors were encountered during processing messages",
 }, []string{"key", "name"})
 
+var saveErrCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "stream_replicator_limiter_memory_save_errors",
+	Help: "How many times saving the last seen cache to its backend failed",
+}, []string{"key", "name"})
+
 func init() {
 	prometheus.MustRegister(seenGauge)
 	prometheus.MustRegister(skippedCtr)
 	prometheus.MustRegister(passedCtr)
 	prometheus.MustRegister(errCtr)
+	prometheus.MustRegister(saveErrCtr)
 }
 
-func (m *Limiter) Configure(ctx context.Context, wg *sync.WaitGroup, key string, age time.Duration, topic string) error {
+var _ limiter.Limiter = &LocalLimiter{}
+
+func (m *LocalLimiter) Configure(ctx context.Context, wg *sync.WaitGroup, key string, age time.Duration, topic string) error {
 	m.mu = &sync.Mutex{}
 	m.key = key
 	m.age = age
 	m.topic = topic
 	m.log = logrus.WithFields(logrus.Fields{"key": key, "age": age, "topic": topic})
 
-	if config.StateDirectory() != "" {
-		m.statefile = filepath.Join(config.StateDirectory(), fmt.Sprintf("%s.json", topic))
+	backend, err := config.StateStoreBackend()
+	if err != nil {
+		return err
 	}
+	m.backend = backend
 
-	m.seen = make(map[string]time.Time)
+	m.dirty = make(map[string]time.Time)
 
-	m.readCache()
+	m.seen, err = m.backend.Load(ctx, topic)
+	if err != nil {
+		m.log.Errorf("Could not load last seen cache, starting with an empty cache: %s", err)
+		m.seen = make(map[string]time.Time)
+	} else {
+		m.scrub()
+		m.log.Infof("Loaded last seen cache with %d entries", len(m.seen))
+	}
 
 	wg.Add(1)
 	go m.cacher(ctx, wg)
 	wg.Add(1)
 	go m.scrubber(ctx, wg)
 	wg.Add(1)
+	go m.compactor(ctx, wg)
+	wg.Add(1)
 	go m.promUpdater(ctx, wg)
 
 	return nil
 }
 
-func (m *Limiter) ProcessAndRecord(msg *stan.Msg, f func(msg *stan.Msg, process bool) error) error {
+func (m *LocalLimiter) ProcessAndRecord(msg *stan.Msg, f func(msg *stan.Msg, process bool) error) error {
+	process := m.Decide(msg)
+
+	err := f(msg, process)
+	if err != nil {
+		errCtr.WithLabelValues(m.key, m.topic).Inc()
+		return err
+	}
+
+	if process {
+		m.Record(msg)
+	}
+
+	return nil
+}
+
+// Decide reports whether msg should be processed, without recording
+// anything - callers that use it directly must call Record themselves
+// once the processing it allowed through has actually succeeded
+func (m *LocalLimiter) Decide(msg *stan.Msg) bool {
 	if m.key == "" {
 		passedCtr.WithLabelValues(m.key, m.topic).Inc()
-		return f(msg, true)
+		return true
 	}
 
 	value := gjson.GetBytes(msg.Data, m.key).String()
@@ -101,22 +168,25 @@ func (m *Limiter) ProcessAndRecord(msg *stan.Msg, f func(msg *stan.Msg, process
 		skippedCtr.WithLabelValues(m.key, m.topic).Inc()
 	}
 
-	err := f(msg, process)
-	if err != nil {
-		errCtr.WithLabelValues(m.key, m.topic).Inc()
-		return err
-	}
+	return process
+}
 
-	if process {
-		m.mu.Lock()
-		m.seen[value] = time.Now()
-		m.mu.Unlock()
+// Record marks msg's tracked value as seen
+func (m *LocalLimiter) Record(msg *stan.Msg) {
+	if m.key == "" {
+		return
 	}
 
-	return nil
+	value := gjson.GetBytes(msg.Data, m.key).String()
+	now := time.Now()
+
+	m.mu.Lock()
+	m.seen[value] = now
+	m.dirty[value] = now
+	m.mu.Unlock()
 }
 
-func (m *Limiter) shouldProcess(value string) bool {
+func (m *LocalLimiter) shouldProcess(value string) bool {
 	if value == "" {
 		return true
 	}
@@ -140,122 +210,143 @@ func (m *Limiter) shouldProcess(value string) bool {
 	return false
 }
 
-func (m *Limiter) readCache() error {
+// takeDirty returns and clears the entries accumulated since the last
+// successful save
+func (m *LocalLimiter) takeDirty() map[string]time.Time {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if m.statefile == "" {
-		m.log.Warn("No state_dir configured, last seen cache is not saved")
+	if len(m.dirty) == 0 {
 		return nil
 	}
 
-	if len(m.seen) > 0 {
-		return fmt.Errorf("last seen cache is not empty")
-	}
-
-	d, err := ioutil.ReadFile(m.statefile)
-	if err != nil {
-		return err
-	}
+	dirty := m.dirty
+	m.dirty = make(map[string]time.Time)
 
-	err = json.Unmarshal(d, &m.seen)
-	if err != nil {
-		return err
-	}
+	return dirty
+}
 
-	killtime := time.Now().Add((-1 * m.age) - (10 * time.Minute))
+// restoreDirty merges dirty back in after a failed save so it is retried
+// on the next attempt rather than lost
+func (m *LocalLimiter) restoreDirty(dirty map[string]time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	for i, t := range m.seen {
-		if t.Before(killtime) {
-			delete(m.seen, i)
+	for k, v := range dirty {
+		if _, found := m.dirty[k]; !found {
+			m.dirty[k] = v
 		}
 	}
-
-	m.log.Infof("Read %d bytes of last-seen data from cache file %s.  After scrubbing old entries the last-seen data has %d entries.", len(d), m.statefile, len(m.seen))
-
-	return nil
 }
 
-func (m *Limiter) writeCache() error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+func (m *LocalLimiter) save(ctx context.Context) error {
+	m.ioMu.Lock()
+	defer m.ioMu.Unlock()
 
-	if len(m.seen) == 0 {
+	dirty := m.takeDirty()
+	if dirty == nil {
 		return nil
 	}
 
-	content, err := json.Marshal(m.seen)
-	if err != nil {
-		m.log.Errorf("Could not JSON encode last seen data: %s", err)
+	if err := m.backend.SaveIncremental(ctx, m.topic, dirty); err != nil {
+		m.restoreDirty(dirty)
 		return err
 	}
 
-	tmpfile, err := ioutil.TempFile(config.StateDirectory(), "memcache")
-	if err != nil {
-		m.log.Errorf("Could not create temp file: %s", err)
-		return err
-	}
+	return nil
+}
 
-	written, err := tmpfile.Write(content)
-	if err != nil {
-		m.log.Errorf("Could not write to temp file: %s", err)
-		return err
-	}
+func (m *LocalLimiter) cacher(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
 
-	err = tmpfile.Close()
-	if err != nil {
-		m.log.Errorf("Could not close temp file: %s", err)
-		return err
-	}
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
 
-	m.log.Debugf("Wrote %d bytes to temp file %s", written, tmpfile.Name())
+	backoff := time.Second
 
-	err = os.Rename(tmpfile.Name(), m.statefile)
-	if err != nil {
-		m.log.Errorf("Could not rename file: %s", err)
-		return err
+	save := func() {
+		for {
+			err := m.save(ctx)
+			if err == nil {
+				backoff = time.Second
+				return
+			}
+
+			saveErrCtr.WithLabelValues(m.key, m.topic).Inc()
+			m.log.Errorf("Could not save last seen data to backend, will retry in %s: %s", backoff, err)
+
+			select {
+			case <-time.After(backoff + time.Duration(rand.Int63n(int64(backoff)))):
+			case <-ctx.Done():
+				return
+			}
+
+			backoff *= 2
+			if backoff > maxSaveBackoff {
+				backoff = maxSaveBackoff
+			}
+		}
 	}
 
-	m.log.Debugf("Wrote %d bytes to last seen cache %s", len(content), m.statefile)
+	for {
+		select {
+		case <-ticker.C:
+			save()
+
+		case <-ctx.Done():
+			m.log.Infof("Saving last seen state on exit")
+			save()
 
-	return nil
+			return
+		}
+	}
 }
 
-func (m *Limiter) cacher(ctx context.Context, wg *sync.WaitGroup) {
-	defer wg.Done()
+// compact writes the full, currently scrubbed m.seen map to the backend
+// as a Save, so that keys scrub() has already dropped locally are also
+// dropped from the backend rather than lingering there forever under
+// SaveIncremental's merge-only semantics. It holds ioMu for the whole
+// snapshot-then-write operation so it can never land after a concurrent
+// save's SaveIncremental for a value this snapshot predates - see ioMu.
+func (m *LocalLimiter) compact(ctx context.Context) error {
+	m.ioMu.Lock()
+	defer m.ioMu.Unlock()
 
-	if m.statefile == "" {
-		m.log.Warn("Last seen timestamps cannot be saved, state_dir is not set")
-		return
+	m.mu.Lock()
+	snapshot := make(statestore.Snapshot, len(m.seen))
+	for k, v := range m.seen {
+		snapshot[k] = v
 	}
+	m.mu.Unlock()
+
+	return m.backend.Save(ctx, m.topic, snapshot)
+}
 
-	ticker := time.NewTicker(30 * time.Second)
+func (m *LocalLimiter) compactor(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
 
-	writer := func() {
-		err := m.writeCache()
-		if err != nil {
-			m.log.Errorf("Could not write last seen data to cache: %s", err)
-		}
-	}
+	ticker := time.NewTicker(compactInterval)
+	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			writer()
+			if err := m.compact(ctx); err != nil {
+				saveErrCtr.WithLabelValues(m.key, m.topic).Inc()
+				m.log.Errorf("Could not compact last seen cache to backend: %s", err)
+			}
 
 		case <-ctx.Done():
-			m.log.Infof("Saving last seen state on exit")
-			writer()
-
 			return
 		}
 	}
 }
 
-func (m *Limiter) promUpdater(ctx context.Context, wg *sync.WaitGroup) {
+func (m *LocalLimiter) promUpdater(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
 
 	for {
 		select {
@@ -270,7 +361,7 @@ func (m *Limiter) promUpdater(ctx context.Context, wg *sync.WaitGroup) {
 	}
 }
 
-func (m *Limiter) scrub() {
+func (m *LocalLimiter) scrub() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -283,9 +374,10 @@ func (m *Limiter) scrub() {
 	}
 }
 
-func (m *Limiter) scrubber(ctx context.Context, wg *sync.WaitGroup) {
+func (m *LocalLimiter) scrubber(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
 
 	for {
 		select {
@@ -0,0 +1,218 @@
+package memory
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/choria-io/stream-replicator/statestore"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeBackend is a minimal in-memory statestore.Backend used to drive
+// LocalLimiter without a real file or S3 backend
+type fakeBackend struct {
+	mu       sync.Mutex
+	snapshot statestore.Snapshot
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{snapshot: make(statestore.Snapshot)}
+}
+
+func (f *fakeBackend) Load(ctx context.Context, topic string) (statestore.Snapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := make(statestore.Snapshot, len(f.snapshot))
+	for k, v := range f.snapshot {
+		out[k] = v
+	}
+
+	return out, nil
+}
+
+func (f *fakeBackend) Save(ctx context.Context, topic string, snapshot statestore.Snapshot) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.snapshot = make(statestore.Snapshot, len(snapshot))
+	for k, v := range snapshot {
+		f.snapshot[k] = v
+	}
+
+	return nil
+}
+
+func (f *fakeBackend) SaveIncremental(ctx context.Context, topic string, delta statestore.Snapshot) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for k, v := range delta {
+		f.snapshot[k] = v
+	}
+
+	return nil
+}
+
+func newTestLimiter(backend statestore.Backend) *LocalLimiter {
+	return &LocalLimiter{
+		key:     "value",
+		age:     time.Hour,
+		topic:   "topic",
+		backend: backend,
+		seen:    make(map[string]time.Time),
+		dirty:   make(map[string]time.Time),
+		mu:      &sync.Mutex{},
+		log:     logrus.NewEntry(logrus.New()),
+	}
+}
+
+// TestCompact_RemovesScrubbedEntriesFromBackend is a regression test for
+// the gap where SaveIncremental only ever merges entries in: scrub()
+// drops expired keys from m.seen locally, but without a periodic full
+// Save those keys would never be removed from the backend.
+func TestCompact_RemovesScrubbedEntriesFromBackend(t *testing.T) {
+	backend := newFakeBackend()
+	m := newTestLimiter(backend)
+
+	m.seen["expired"] = time.Now().Add(-48 * time.Hour)
+	m.seen["live"] = time.Now()
+	m.dirty["expired"] = m.seen["expired"]
+	m.dirty["live"] = m.seen["live"]
+
+	if err := m.save(context.Background()); err != nil {
+		t.Fatalf("unexpected error saving dirty entries: %s", err)
+	}
+
+	if _, found := backend.snapshot["expired"]; !found {
+		t.Fatal("setup: expected SaveIncremental to have written the expired entry")
+	}
+
+	m.scrub()
+	if _, found := m.seen["expired"]; found {
+		t.Fatal("setup: expected scrub to remove the expired entry locally")
+	}
+
+	if err := m.compact(context.Background()); err != nil {
+		t.Fatalf("unexpected error compacting: %s", err)
+	}
+
+	if _, found := backend.snapshot["expired"]; found {
+		t.Fatal("expected compact's full Save to drop the entry scrub removed locally")
+	}
+	if _, found := backend.snapshot["live"]; !found {
+		t.Fatal("expected compact to keep the still-live entry")
+	}
+}
+
+// slowSaveBackend wraps a fakeBackend whose Save blocks on started/
+// release channels, letting a test observe and control exactly when a
+// full Save is in flight
+type slowSaveBackend struct {
+	*fakeBackend
+	started chan struct{}
+	release chan struct{}
+}
+
+func newSlowSaveBackend() *slowSaveBackend {
+	return &slowSaveBackend{
+		fakeBackend: newFakeBackend(),
+		started:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+}
+
+func (b *slowSaveBackend) Save(ctx context.Context, topic string, snapshot statestore.Snapshot) error {
+	close(b.started)
+	<-b.release
+
+	return b.fakeBackend.Save(ctx, topic, snapshot)
+}
+
+// TestCompactAndSave_Serialized is a regression test for the interleaving
+// where a compact's full Save, snapshotted before a newer Record, lands
+// in the backend after that Record's own incremental save already did -
+// silently reverting the backend to the older last-seen timestamp. With
+// save and compact serialized by ioMu, save must not be able to complete
+// until compact's in-flight Save has landed, so its result is never
+// clobbered by the stale snapshot.
+func TestCompactAndSave_Serialized(t *testing.T) {
+	backend := newSlowSaveBackend()
+	m := newTestLimiter(backend)
+
+	stale := time.Now().Add(-time.Minute)
+	m.seen["key"] = stale
+
+	compactErr := make(chan error, 1)
+	go func() {
+		compactErr <- m.compact(context.Background())
+	}()
+
+	<-backend.started // compact has snapshotted "key" at `stale` and is now blocked in Save
+
+	fresh := time.Now()
+	m.mu.Lock()
+	m.seen["key"] = fresh
+	m.dirty["key"] = fresh
+	m.mu.Unlock()
+
+	saveErr := make(chan error, 1)
+	go func() {
+		saveErr <- m.save(context.Background())
+	}()
+
+	select {
+	case err := <-saveErr:
+		t.Fatalf("save completed (err=%v) before compact's in-flight Save landed - it is not serialized against compact", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(backend.release)
+
+	if err := <-compactErr; err != nil {
+		t.Fatalf("unexpected error from compact: %s", err)
+	}
+	if err := <-saveErr; err != nil {
+		t.Fatalf("unexpected error from save: %s", err)
+	}
+
+	if got := backend.snapshot["key"]; !got.Equal(fresh) {
+		t.Fatalf("expected the newer value to survive compact's stale Save, got %v want %v", got, fresh)
+	}
+}
+
+func TestSave_RestoresDirtyOnBackendError(t *testing.T) {
+	m := newTestLimiter(&failingBackend{})
+
+	m.dirty["a"] = time.Now()
+
+	if err := m.save(context.Background()); err == nil {
+		t.Fatal("expected the backend error to propagate")
+	}
+
+	if _, found := m.dirty["a"]; !found {
+		t.Fatal("expected a failed save to restore the dirty entry for retry")
+	}
+}
+
+type failingBackend struct{}
+
+func (f *failingBackend) Load(ctx context.Context, topic string) (statestore.Snapshot, error) {
+	return make(statestore.Snapshot), nil
+}
+
+func (f *failingBackend) Save(ctx context.Context, topic string, snapshot statestore.Snapshot) error {
+	return errBackend
+}
+
+func (f *failingBackend) SaveIncremental(ctx context.Context, topic string, delta statestore.Snapshot) error {
+	return errBackend
+}
+
+var errBackend = &backendError{"simulated backend error"}
+
+type backendError struct{ msg string }
+
+func (e *backendError) Error() string { return e.msg }
@@ -0,0 +1,60 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/choria-io/stream-replicator/leader"
+	stan "github.com/nats-io/go-nats-streaming"
+)
+
+// WithLeaderElection wraps a Limiter so that only the elected leader for
+// the topic is allowed to process messages. Non-leaders still run the
+// wrapped Limiter so their local/remote cache stays warm for when they
+// are promoted, but the decision reaching the callback is forced to
+// false while leadership sits elsewhere.
+type WithLeaderElection struct {
+	Limiter
+	elector *leader.Elector
+}
+
+// NewWithLeaderElection wraps l with leader election driven by elector
+func NewWithLeaderElection(l Limiter, elector *leader.Elector) *WithLeaderElection {
+	return &WithLeaderElection{Limiter: l, elector: elector}
+}
+
+func (w *WithLeaderElection) Configure(ctx context.Context, wg *sync.WaitGroup, key string, age time.Duration, topic string) error {
+	if err := w.Limiter.Configure(ctx, wg, key, age, topic); err != nil {
+		return err
+	}
+
+	return w.elector.Run(ctx, wg, topic)
+}
+
+func (w *WithLeaderElection) ProcessAndRecord(msg *stan.Msg, f func(msg *stan.Msg, process bool) error) error {
+	return w.Limiter.ProcessAndRecord(msg, func(msg *stan.Msg, process bool) error {
+		return f(msg, process && w.elector.IsLeader())
+	})
+}
+
+// Decide reports whether msg should be processed according to the
+// wrapped Limiter alone - it is not gated on leadership here, because
+// callers that use Decide directly (such as publisher.QueueManager) also
+// call Record from the same decision, and a standby must still record
+// the value as seen to keep its cache warm for when it is promoted.
+// Leadership gates whether the message is actually published, which
+// happens at the publish call site instead, same as ProcessAndRecord
+// above.
+func (w *WithLeaderElection) Decide(msg *stan.Msg) bool {
+	return w.Limiter.Decide(msg)
+}
+
+// Record marks msg's tracked value as seen with the wrapped Limiter,
+// regardless of leadership - keeping a standby's cache warm for when it
+// is promoted is the whole point of still running the wrapped Limiter
+func (w *WithLeaderElection) Record(msg *stan.Msg) {
+	w.Limiter.Record(msg)
+}
+
+var _ Limiter = &WithLeaderElection{}
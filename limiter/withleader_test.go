@@ -0,0 +1,127 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/choria-io/stream-replicator/leader"
+	stan "github.com/nats-io/go-nats-streaming"
+)
+
+// fakeElectorBackend drives a leader.Elector to a fixed leadership state
+// synchronously, without campaigning against a real backend
+type fakeElectorBackend struct {
+	isLeader bool
+	fencing  uint64
+}
+
+func (f *fakeElectorBackend) Campaign(ctx context.Context, wg *sync.WaitGroup, topic string, onChange func(isLeader bool, fencing uint64)) error {
+	onChange(f.isLeader, f.fencing)
+	return nil
+}
+
+func newTestElector(t *testing.T, isLeader bool) *leader.Elector {
+	t.Helper()
+
+	e := leader.New(&fakeElectorBackend{isLeader: isLeader, fencing: 7})
+	if err := e.Run(context.Background(), &sync.WaitGroup{}, "topic"); err != nil {
+		t.Fatalf("unexpected error running test elector: %s", err)
+	}
+
+	return e
+}
+
+// fakeLimiter is a minimal Limiter whose decision is fixed, modeled on
+// how memory.LocalLimiter and distributed.Limiter implement
+// ProcessAndRecord in terms of Decide/Record
+type fakeLimiter struct {
+	decide   bool
+	recorded int
+}
+
+func (f *fakeLimiter) Configure(ctx context.Context, wg *sync.WaitGroup, key string, age time.Duration, topic string) error {
+	return nil
+}
+
+func (f *fakeLimiter) ProcessAndRecord(msg *stan.Msg, fn func(msg *stan.Msg, process bool) error) error {
+	process := f.decide
+
+	if err := fn(msg, process); err != nil {
+		return err
+	}
+
+	if process {
+		f.Record(msg)
+	}
+
+	return nil
+}
+
+func (f *fakeLimiter) Decide(msg *stan.Msg) bool {
+	return f.decide
+}
+
+func (f *fakeLimiter) Record(msg *stan.Msg) {
+	f.recorded++
+}
+
+var _ Limiter = &fakeLimiter{}
+
+// TestWithLeaderElection_DecideIsNotGatedByLeadership is a regression
+// test: Decide must return the wrapped Limiter's raw decision regardless
+// of leadership, because callers that use Decide/Record directly (such
+// as publisher.QueueManager) rely on the raw decision to keep a
+// standby's cache warm - gating here would make that impossible since
+// Record is only ever called for values Decide said should be recorded.
+func TestWithLeaderElection_DecideIsNotGatedByLeadership(t *testing.T) {
+	fl := &fakeLimiter{decide: true}
+	w := NewWithLeaderElection(fl, newTestElector(t, false))
+
+	if !w.Decide(nil) {
+		t.Fatal("expected Decide to return the wrapped limiter's raw decision even while standby")
+	}
+}
+
+// TestWithLeaderElection_ProcessAndRecordGatesCallbackOnly checks that
+// ProcessAndRecord gates what the callback sees by leadership, while
+// still recording the value with the wrapped limiter regardless - so a
+// standby that is later promoted does not re-deliver everything it
+// never recorded.
+func TestWithLeaderElection_ProcessAndRecordGatesCallbackOnly(t *testing.T) {
+	fl := &fakeLimiter{decide: true}
+	w := NewWithLeaderElection(fl, newTestElector(t, false))
+
+	var gotProcess bool
+	err := w.ProcessAndRecord(nil, func(msg *stan.Msg, process bool) error {
+		gotProcess = process
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if gotProcess {
+		t.Fatal("expected the callback to see process=false while this instance is a standby")
+	}
+	if fl.recorded != 1 {
+		t.Fatalf("expected the wrapped limiter to record the value to stay warm, recorded=%d", fl.recorded)
+	}
+}
+
+func TestWithLeaderElection_ProcessAndRecordPassesThroughWhenLeader(t *testing.T) {
+	fl := &fakeLimiter{decide: true}
+	w := NewWithLeaderElection(fl, newTestElector(t, true))
+
+	var gotProcess bool
+	err := w.ProcessAndRecord(nil, func(msg *stan.Msg, process bool) error {
+		gotProcess = process
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !gotProcess {
+		t.Fatal("expected the callback to see process=true while this instance is leader")
+	}
+}
@@ -0,0 +1,34 @@
+package publisher
+
+import "time"
+
+// ewmaAlpha weights how quickly the moving average reacts to new
+// samples, matching the smoothing factor Prometheus's remote-write
+// queue manager uses for its own shard scaling calculations
+const ewmaAlpha = 0.2
+
+// ewma is a simple exponentially weighted moving average, used to track
+// both send latency and incoming/outgoing message rates without needing
+// a full sample history
+type ewma struct {
+	value float64
+	set   bool
+}
+
+func (e *ewma) update(sample float64) {
+	if !e.set {
+		e.value = sample
+		e.set = true
+		return
+	}
+
+	e.value = ewmaAlpha*sample + (1-ewmaAlpha)*e.value
+}
+
+func (e *ewma) get() float64 {
+	return e.value
+}
+
+func durationToSeconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Second)
+}
@@ -0,0 +1,42 @@
+package publisher
+
+import "testing"
+
+func TestEwma_FirstSampleIsTheValue(t *testing.T) {
+	var e ewma
+
+	e.update(10)
+
+	if got := e.get(); got != 10 {
+		t.Fatalf("expected first sample to set the value outright, got %v", got)
+	}
+}
+
+func TestEwma_SmoothsTowardsNewSamples(t *testing.T) {
+	var e ewma
+
+	e.update(10)
+	e.update(20)
+
+	got := e.get()
+	if got <= 10 || got >= 20 {
+		t.Fatalf("expected smoothed value strictly between old and new sample, got %v", got)
+	}
+
+	want := ewmaAlpha*20 + (1-ewmaAlpha)*10
+	if got != want {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestEwma_ConvergesOnARepeatedSample(t *testing.T) {
+	var e ewma
+
+	for i := 0; i < 100; i++ {
+		e.update(5)
+	}
+
+	if got := e.get(); got != 5 {
+		t.Fatalf("expected ewma to converge on a constant sample, got %v", got)
+	}
+}
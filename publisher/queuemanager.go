@@ -0,0 +1,319 @@
+// Package publisher decouples the limiter from the destination it
+// publishes to. Today calling the publish callback inline on the
+// consumer goroutine means a slow or flapping destination stalls the
+// whole topic; QueueManager fans messages out to a pool of shards, each
+// with its own bounded queue, batching, and retry with backoff, and
+// grows or shrinks that pool to match the observed send rate.
+package publisher
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/choria-io/stream-replicator/leader"
+	"github.com/choria-io/stream-replicator/limiter"
+	"github.com/choria-io/stream-replicator/ring"
+	stan "github.com/nats-io/go-nats-streaming"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// PublishFunc is the signature a shard calls to send a job once the
+// limiter has decided whether it should be processed - internally it is
+// QueueManager.publish, which stamps the current leader fencing token
+// onto the call to DestinationFunc
+type PublishFunc func(msg *stan.Msg, process bool) error
+
+// DestinationFunc is the real work of delivering a message downstream.
+// fencing is the current leader's fencing token (see leader.Elector);
+// it should be stamped onto the outgoing message so a zombie leader's
+// stale writes can be detected and rejected downstream.
+type DestinationFunc func(msg *stan.Msg, process bool, fencing uint64) error
+
+// Config bounds a QueueManager's shard pool, batching and retry behaviour
+type Config struct {
+	// MinShards and MaxShards bound how many shards the pool scales
+	// between as load changes
+	MinShards int
+	MaxShards int
+
+	// QueueCapacity is how many messages a single shard buffers before
+	// Enqueue starts reporting backpressure
+	QueueCapacity int
+
+	// MaxSamplesPerSend and BatchSendDeadline bound how large a batch a
+	// shard accumulates before processing it - whichever is hit first
+	MaxSamplesPerSend int
+	BatchSendDeadline time.Duration
+
+	// MinRetryBackoff and MaxRetryBackoff bound the backoff applied
+	// between retries of a failed send
+	MinRetryBackoff time.Duration
+	MaxRetryBackoff time.Duration
+
+	// ScaleInterval is how often the shard count is reconsidered
+	ScaleInterval time.Duration
+}
+
+// DefaultConfig returns sane defaults for a QueueManager
+func DefaultConfig() Config {
+	return Config{
+		MinShards:         1,
+		MaxShards:         16,
+		QueueCapacity:     1000,
+		MaxSamplesPerSend: 100,
+		BatchSendDeadline: 5 * time.Second,
+		MinRetryBackoff:   100 * time.Millisecond,
+		MaxRetryBackoff:   30 * time.Second,
+		ScaleInterval:     10 * time.Second,
+	}
+}
+
+var queueDepthGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "stream_replicator_publisher_queue_depth",
+	Help: "How many messages are queued in a publisher shard",
+}, []string{"key", "name", "shard"})
+
+var retryCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "stream_replicator_publisher_retries",
+	Help: "How many times a publisher shard had to retry a send",
+}, []string{"key", "name", "shard"})
+
+var latencyGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "stream_replicator_publisher_send_latency_seconds",
+	Help: "Exponentially weighted moving average of a publisher shard's send latency",
+}, []string{"key", "name", "shard"})
+
+var shardsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "stream_replicator_publisher_shards",
+	Help: "How many shards a publisher's queue manager currently runs",
+}, []string{"key", "name"})
+
+func init() {
+	prometheus.MustRegister(queueDepthGauge)
+	prometheus.MustRegister(retryCtr)
+	prometheus.MustRegister(latencyGauge)
+	prometheus.MustRegister(shardsGauge)
+}
+
+func shardLabel(id int) string {
+	return fmt.Sprintf("%d", id)
+}
+
+// QueueManager sits between the limiter and the destination callback,
+// fanning messages out to shards keyed by the limiter's tracked value so
+// per-sender ordering is preserved while different senders proceed in
+// parallel and a slow destination no longer stalls the whole topic.
+//
+// Shard ownership of a value is assigned via a consistent hash ring
+// rather than plain modulo, so growing or shrinking the shard pool only
+// remaps the values owned by the shards actually added or removed,
+// instead of reshuffling ownership of nearly every tracked sender.
+type QueueManager struct {
+	key         string
+	topic       string
+	lim         limiter.Limiter
+	destination DestinationFunc
+	elector     *leader.Elector
+	cfg         Config
+	log         *logrus.Entry
+
+	mu          sync.RWMutex
+	shards      []*shard
+	shardRing   *ring.Ring
+	nextShardID int
+	wg          *sync.WaitGroup
+	ctx         context.Context
+
+	enqueuedSinceTick int64
+
+	inRate  ewma
+	outRate ewma
+}
+
+// New creates a QueueManager that dispatches through lim to destination,
+// sharding by the value found at key in each message. elector may be nil
+// if the topic has no leader election configured, in which case a
+// fencing token of 0 is always stamped.
+func New(lim limiter.Limiter, destination DestinationFunc, elector *leader.Elector, key, topic string, cfg Config) *QueueManager {
+	return &QueueManager{
+		key:         key,
+		topic:       topic,
+		lim:         lim,
+		destination: destination,
+		elector:     elector,
+		cfg:         cfg,
+		shardRing:   ring.New(),
+		log:         logrus.WithFields(logrus.Fields{"key": key, "topic": topic, "component": "publisher"}),
+	}
+}
+
+// publish adapts destination to the PublishFunc signature a shard
+// calls, stamping in the current leader fencing token and gating the
+// process decision on leadership - process reaching this point is the
+// limiter's raw decision, not yet gated, so a standby still recorded the
+// value as seen to keep its cache warm; this is the equivalent of the
+// gate limiter.WithLeaderElection.ProcessAndRecord applies for callers
+// that go through that path instead of Enqueue directly
+func (q *QueueManager) publish(msg *stan.Msg, process bool) error {
+	var fencing uint64
+	if q.elector != nil {
+		fencing = q.elector.FencingToken()
+		process = process && q.elector.IsLeader()
+	}
+
+	return q.destination(msg, process, fencing)
+}
+
+// Configure starts the shard pool at Config.MinShards and the autoscaler
+func (q *QueueManager) Configure(ctx context.Context, wg *sync.WaitGroup) error {
+	q.ctx = ctx
+	q.wg = wg
+
+	q.mu.Lock()
+	for i := 0; i < q.cfg.MinShards; i++ {
+		q.addShardLocked(ctx, wg)
+	}
+	q.mu.Unlock()
+
+	wg.Add(1)
+	go q.autoscaler(ctx, wg)
+
+	return nil
+}
+
+// Enqueue routes msg to the shard owning its tracked value. It returns
+// an error if that shard's queue is full, rather than blocking the
+// caller, so a stalled destination cannot stall message consumption.
+func (q *QueueManager) Enqueue(msg *stan.Msg, process bool) error {
+	value := gjson.GetBytes(msg.Data, q.key).String()
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	atomic.AddInt64(&q.enqueuedSinceTick, 1)
+
+	s := q.shardFor(value)
+	if !s.enqueue(msg, process) {
+		return fmt.Errorf("shard %d queue is full", s.id)
+	}
+
+	return nil
+}
+
+// shardFor returns the shard owning value according to the current ring
+func (q *QueueManager) shardFor(value string) *shard {
+	owner := q.shardRing.Owner(value)
+	for _, s := range q.shards {
+		if strconv.Itoa(s.id) == owner {
+			return s
+		}
+	}
+
+	return q.shards[0]
+}
+
+// rebuildRingLocked refreshes the ring's membership from the current
+// shard pool - callers must hold q.mu
+func (q *QueueManager) rebuildRingLocked() {
+	owners := make([]string, len(q.shards))
+	for i, s := range q.shards {
+		owners[i] = strconv.Itoa(s.id)
+	}
+
+	q.shardRing.Set(owners)
+}
+
+func (q *QueueManager) addShardLocked(ctx context.Context, wg *sync.WaitGroup) {
+	s := newShard(q.nextShardID, q.lim, q.publish, q.cfg, q.key, q.topic)
+	q.nextShardID++
+	q.shards = append(q.shards, s)
+	q.rebuildRingLocked()
+
+	wg.Add(1)
+	go s.run(ctx, wg, q.requeue)
+
+	shardsGauge.WithLabelValues(q.key, q.topic).Set(float64(len(q.shards)))
+}
+
+// requeue is handed to a retiring shard so jobs still sitting in its
+// queue are redistributed to the shard that now owns their tracked
+// value, rather than lost or funnelled onto a single arbitrary shard
+func (q *QueueManager) requeue(j job) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if len(q.shards) == 0 {
+		return
+	}
+
+	value := gjson.GetBytes(j.msg.Data, q.key).String()
+	q.shardFor(value).enqueue(j.msg, j.process)
+}
+
+// autoscaler grows the shard pool when the incoming rate is outrunning
+// the outgoing send rate, and shrinks it back down when there is slack,
+// mirroring the approach Prometheus's remote-write queue manager uses to
+// size its own shard pool off an EWMA of sample rates
+func (q *QueueManager) autoscaler(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(q.cfg.ScaleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			q.rescale()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (q *QueueManager) rescale() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var processed int64
+	for _, s := range q.shards {
+		processed += s.takeProcessed()
+	}
+
+	enqueued := atomic.SwapInt64(&q.enqueuedSinceTick, 0)
+
+	q.inRate.update(float64(enqueued) / q.cfg.ScaleInterval.Seconds())
+	q.outRate.update(float64(processed) / q.cfg.ScaleInterval.Seconds())
+
+	in, out := q.inRate.get(), q.outRate.get()
+
+	switch {
+	case in > out*1.2 && len(q.shards) < q.cfg.MaxShards:
+		q.log.Infof("Incoming rate %.2f/s exceeds outgoing %.2f/s, adding a shard", in, out)
+		q.addShardLocked(q.ctx, q.wg)
+
+	case out > in*1.5 && len(q.shards) > q.cfg.MinShards:
+		q.log.Infof("Outgoing capacity %.2f/s exceeds incoming %.2f/s, removing a shard", out, in)
+		q.removeShardLocked()
+	}
+}
+
+// removeShardLocked retires the most recently added shard. Its worker
+// hands any jobs still queued to requeue before exiting, so nothing is
+// lost.
+func (q *QueueManager) removeShardLocked() {
+	last := len(q.shards) - 1
+	removed := q.shards[last]
+	q.shards = q.shards[:last]
+	q.rebuildRingLocked()
+
+	close(removed.stop)
+
+	shardsGauge.WithLabelValues(q.key, q.topic).Set(float64(len(q.shards)))
+}
@@ -0,0 +1,144 @@
+package publisher
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/choria-io/stream-replicator/leader"
+	"github.com/choria-io/stream-replicator/ring"
+	stan "github.com/nats-io/go-nats-streaming"
+)
+
+// fakeElectorBackend drives a leader.Elector to a fixed leadership state
+// synchronously, without campaigning against a real backend
+type fakeElectorBackend struct {
+	isLeader bool
+	fencing  uint64
+}
+
+func (f *fakeElectorBackend) Campaign(ctx context.Context, wg *sync.WaitGroup, topic string, onChange func(isLeader bool, fencing uint64)) error {
+	onChange(f.isLeader, f.fencing)
+	return nil
+}
+
+func newTestElector(t *testing.T, isLeader bool) *leader.Elector {
+	t.Helper()
+
+	e := leader.New(&fakeElectorBackend{isLeader: isLeader, fencing: 3})
+	if err := e.Run(context.Background(), &sync.WaitGroup{}, "topic"); err != nil {
+		t.Fatalf("unexpected error running test elector: %s", err)
+	}
+
+	return e
+}
+
+func newTestQueueManager(shardIDs ...int) *QueueManager {
+	q := &QueueManager{shardRing: ring.New()}
+
+	for _, id := range shardIDs {
+		q.shards = append(q.shards, &shard{id: id})
+	}
+	q.rebuildRingLocked()
+
+	return q
+}
+
+func TestQueueManager_ShardForIsStableForSameMembership(t *testing.T) {
+	q := newTestQueueManager(0, 1, 2, 3)
+
+	first := q.shardFor("sender-1").id
+	for i := 0; i < 10; i++ {
+		if got := q.shardFor("sender-1").id; got != first {
+			t.Fatalf("shard assignment changed across calls with unchanged membership: %d vs %d", first, got)
+		}
+	}
+}
+
+func TestQueueManager_ShardForKeepsMostSendersOnResize(t *testing.T) {
+	q := newTestQueueManager(0, 1, 2, 3)
+
+	values := make([]string, 500)
+	owners := make(map[string]int, 500)
+	for i := range values {
+		values[i] = fmt.Sprintf("sender-%d", i)
+		owners[values[i]] = q.shardFor(values[i]).id
+	}
+
+	// Grow the pool the way addShardLocked does: append a new shard and
+	// rebuild the ring.
+	q.shards = append(q.shards, &shard{id: 4})
+	q.rebuildRingLocked()
+
+	moved := 0
+	for _, v := range values {
+		if q.shardFor(v).id != owners[v] {
+			moved++
+		}
+	}
+
+	// Plain modulo hashing would remap nearly every sender here; the ring
+	// should only remap the fraction that now belongs to the new shard.
+	if moved > len(values)/2 {
+		t.Fatalf("adding a shard remapped %d/%d senders, expected consistent hashing to remap far fewer", moved, len(values))
+	}
+}
+
+// TestQueueManager_PublishGatesOnLeadership is a regression test: the
+// leadership gate that used to live in limiter.WithLeaderElection.Decide
+// must still apply somewhere, now at the publish call site, so a standby
+// never actually delivers a message even though Decide/Record see its
+// raw, ungated decision.
+func TestQueueManager_PublishGatesOnLeadership(t *testing.T) {
+	var gotProcess bool
+	q := &QueueManager{
+		elector: newTestElector(t, false),
+		destination: func(msg *stan.Msg, process bool, fencing uint64) error {
+			gotProcess = process
+			return nil
+		},
+	}
+
+	if err := q.publish(nil, true); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if gotProcess {
+		t.Fatal("expected publish to gate process to false while this instance is a standby")
+	}
+}
+
+func TestQueueManager_PublishPassesThroughWhenLeader(t *testing.T) {
+	var gotProcess bool
+	q := &QueueManager{
+		elector: newTestElector(t, true),
+		destination: func(msg *stan.Msg, process bool, fencing uint64) error {
+			gotProcess = process
+			return nil
+		},
+	}
+
+	if err := q.publish(nil, true); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !gotProcess {
+		t.Fatal("expected publish to pass the decision through while this instance is leader")
+	}
+}
+
+func TestQueueManager_PublishPassesThroughWithoutAnElector(t *testing.T) {
+	var gotProcess bool
+	q := &QueueManager{
+		destination: func(msg *stan.Msg, process bool, fencing uint64) error {
+			gotProcess = process
+			return nil
+		},
+	}
+
+	if err := q.publish(nil, true); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !gotProcess {
+		t.Fatal("expected publish to pass the decision through unchanged when no elector is configured")
+	}
+}
@@ -0,0 +1,172 @@
+package publisher
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/choria-io/stream-replicator/limiter"
+	stan "github.com/nats-io/go-nats-streaming"
+)
+
+// job is a single queued message waiting to be sent by a shard
+type job struct {
+	msg     *stan.Msg
+	process bool
+}
+
+// shard is one worker of the QueueManager's fan-out pool. It holds a
+// bounded queue of jobs keyed (by the owning QueueManager) to the same
+// tracked value, so while the shard pool keeps its size, messages for a
+// given sender are sent by the same shard in the order they were
+// enqueued. A resize can move a sender to another shard, and its later
+// messages can then be sent before earlier ones still queued elsewhere.
+type shard struct {
+	id      int
+	in      chan job
+	stop    chan struct{}
+	lim     limiter.Limiter
+	publish PublishFunc
+	cfg     Config
+	labels  []string // key, topic, shard id - shared across this shard's metrics
+
+	processedSinceTick int64
+	mu                 sync.Mutex
+
+	latency ewma
+}
+
+func newShard(id int, lim limiter.Limiter, publish PublishFunc, cfg Config, key, topic string) *shard {
+	return &shard{
+		id:      id,
+		in:      make(chan job, cfg.QueueCapacity),
+		stop:    make(chan struct{}),
+		lim:     lim,
+		publish: publish,
+		cfg:     cfg,
+		labels:  []string{key, topic, shardLabel(id)},
+	}
+}
+
+// enqueue adds msg to the shard's queue, returning false if the queue is
+// full so the caller can apply backpressure
+func (s *shard) enqueue(msg *stan.Msg, process bool) bool {
+	select {
+	case s.in <- job{msg: msg, process: process}:
+		queueDepthGauge.WithLabelValues(s.labels...).Set(float64(len(s.in)))
+		return true
+	default:
+		return false
+	}
+}
+
+// run drives the shard's batch/send loop until ctx is cancelled or the
+// shard is retired by the autoscaler via stop. On retirement any jobs
+// still queued are handed to requeue rather than dropped.
+func (s *shard) run(ctx context.Context, wg *sync.WaitGroup, requeue func(job)) {
+	defer wg.Done()
+
+	batch := make([]job, 0, s.cfg.MaxSamplesPerSend)
+	deadline := time.NewTimer(s.cfg.BatchSendDeadline)
+	defer deadline.Stop()
+
+	flush := func() {
+		for _, j := range batch {
+			s.send(ctx, j)
+		}
+		batch = batch[:0]
+		queueDepthGauge.WithLabelValues(s.labels...).Set(float64(len(s.in)))
+	}
+
+	for {
+		select {
+		case j := <-s.in:
+			batch = append(batch, j)
+			if len(batch) >= s.cfg.MaxSamplesPerSend {
+				flush()
+				deadline.Reset(s.cfg.BatchSendDeadline)
+			}
+
+		case <-deadline.C:
+			if len(batch) > 0 {
+				flush()
+			}
+			deadline.Reset(s.cfg.BatchSendDeadline)
+
+		case <-s.stop:
+			flush()
+			for {
+				select {
+				case j := <-s.in:
+					requeue(j)
+				default:
+					return
+				}
+			}
+
+		case <-ctx.Done():
+			flush()
+			return
+		}
+	}
+}
+
+// send delivers j, retrying only the publish with exponential backoff and
+// jitter on failure - the process decision was already made once by
+// whatever called Enqueue, so it is trusted as-is rather than re-run,
+// meaning a flapping destination does not re-run a distributed limiter's
+// NATS round trip or re-increment its counters once per attempt. The
+// tracked value is only marked as seen once the publish eventually
+// succeeds, so a crash mid-retry does not falsely mark an un-sent message
+// as processed.
+func (s *shard) send(ctx context.Context, j job) {
+	process := j.process
+
+	backoff := s.cfg.MinRetryBackoff
+
+	for {
+		start := time.Now()
+		err := s.publish(j.msg, process)
+		s.latency.update(durationToSeconds(time.Since(start)))
+		latencyGauge.WithLabelValues(s.labels...).Set(s.latency.get())
+
+		if err == nil {
+			s.mu.Lock()
+			s.processedSinceTick++
+			s.mu.Unlock()
+
+			if process {
+				s.lim.Record(j.msg)
+			}
+			return
+		}
+
+		retryCtr.WithLabelValues(s.labels...).Inc()
+
+		select {
+		case <-time.After(backoff + time.Duration(rand.Int63n(int64(backoff)+1))):
+		case <-ctx.Done():
+			return
+		}
+
+		if backoff < s.cfg.MaxRetryBackoff {
+			backoff *= 2
+			if backoff > s.cfg.MaxRetryBackoff {
+				backoff = s.cfg.MaxRetryBackoff
+			}
+		}
+	}
+}
+
+// takeProcessed returns and resets the number of messages sent since the
+// last call, used by the autoscaler to compute outgoing rate
+func (s *shard) takeProcessed() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.processedSinceTick
+	s.processedSinceTick = 0
+
+	return n
+}
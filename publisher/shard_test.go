@@ -0,0 +1,127 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/choria-io/stream-replicator/limiter"
+	stan "github.com/nats-io/go-nats-streaming"
+)
+
+// fakeLimiter is a minimal limiter.Limiter for exercising shard.send
+// without pulling in a real limiter backend
+type fakeLimiter struct {
+	decideCalls int
+	recorded    int
+}
+
+func (f *fakeLimiter) Configure(ctx context.Context, wg *sync.WaitGroup, key string, age time.Duration, topic string) error {
+	return nil
+}
+
+func (f *fakeLimiter) ProcessAndRecord(msg *stan.Msg, fn func(msg *stan.Msg, process bool) error) error {
+	return fn(msg, true)
+}
+
+func (f *fakeLimiter) Decide(msg *stan.Msg) bool {
+	f.decideCalls++
+	return true
+}
+
+func (f *fakeLimiter) Record(msg *stan.Msg) {
+	f.recorded++
+}
+
+var _ limiter.Limiter = &fakeLimiter{}
+
+func testShardConfig() Config {
+	cfg := DefaultConfig()
+	cfg.MinRetryBackoff = time.Millisecond
+	cfg.MaxRetryBackoff = 2 * time.Millisecond
+	return cfg
+}
+
+// TestShard_SendTrustsJobProcessWithoutRedeciding is a regression test:
+// send must use job.process as decided by whatever called Enqueue, not
+// call the limiter's Decide again - redeciding would double a
+// distributed limiter's NATS round trip and its pass/skip counters.
+func TestShard_SendTrustsJobProcessWithoutRedeciding(t *testing.T) {
+	lim := &fakeLimiter{}
+	var gotProcess bool
+	publish := func(msg *stan.Msg, process bool) error {
+		gotProcess = process
+		return nil
+	}
+
+	s := newShard(0, lim, publish, testShardConfig(), "key", "topic")
+	s.send(context.Background(), job{process: false})
+
+	if lim.decideCalls != 0 {
+		t.Fatalf("expected send not to call Decide, called %d times", lim.decideCalls)
+	}
+	if gotProcess {
+		t.Fatal("expected publish to receive the job's own process decision")
+	}
+	if lim.recorded != 0 {
+		t.Fatal("expected Record not to be called when process is false")
+	}
+}
+
+func TestShard_SendRetriesUntilSuccessAndRecordsOnce(t *testing.T) {
+	lim := &fakeLimiter{}
+	attempts := 0
+	publish := func(msg *stan.Msg, process bool) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("simulated destination failure")
+		}
+		return nil
+	}
+
+	s := newShard(0, lim, publish, testShardConfig(), "key", "topic")
+	s.send(context.Background(), job{process: true})
+
+	if attempts != 3 {
+		t.Fatalf("expected send to retry until success, got %d attempts", attempts)
+	}
+	if lim.recorded != 1 {
+		t.Fatalf("expected exactly one Record call after the retried send succeeded, got %d", lim.recorded)
+	}
+}
+
+// TestShard_SendStopsRetryingOnContextCancellation is a regression test
+// for the shutdown-hang class of bug: a permanently failing destination
+// must not keep send retrying once ctx is cancelled.
+func TestShard_SendStopsRetryingOnContextCancellation(t *testing.T) {
+	lim := &fakeLimiter{}
+	publish := func(msg *stan.Msg, process bool) error {
+		return errors.New("simulated destination failure")
+	}
+
+	cfg := testShardConfig()
+	cfg.MaxRetryBackoff = time.Hour // would hang indefinitely without the ctx.Done select
+
+	s := newShard(0, lim, publish, cfg, "key", "topic")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	done := make(chan struct{})
+	go func() {
+		s.send(ctx, job{process: true})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(300 * time.Millisecond):
+		t.Fatal("send did not stop retrying promptly after ctx cancellation")
+	}
+
+	if lim.recorded != 0 {
+		t.Fatal("expected no Record call for a send that never succeeded")
+	}
+}
@@ -0,0 +1,78 @@
+// Package ring provides a small consistent hash ring, used wherever a
+// value needs to be assigned to one of a changing set of owners while
+// keeping reassignment limited to the owners actually added or removed
+// (unlike plain modulo hashing, which reshuffles almost everything on
+// every membership change). It backs peer ownership in
+// limiter/distributed and shard assignment in publisher.
+package ring
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"sync"
+)
+
+// VnodesPerOwner controls how many points each owner occupies on the
+// ring, it smooths out the distribution of values across a small number
+// of owners
+const VnodesPerOwner = 100
+
+// Ring is a consistent hash ring used to determine which of a set of
+// owners is authoritative for a given value. It is safe for concurrent
+// use.
+type Ring struct {
+	mu     sync.RWMutex
+	points []uint32
+	owners map[uint32]string
+}
+
+// New creates an empty Ring
+func New() *Ring {
+	return &Ring{
+		owners: make(map[uint32]string),
+	}
+}
+
+// Set replaces the full owner membership of the ring
+func (r *Ring) Set(owners []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.points = r.points[:0]
+	r.owners = make(map[uint32]string)
+
+	for _, o := range owners {
+		for v := 0; v < VnodesPerOwner; v++ {
+			h := hashKey(o, v)
+			r.points = append(r.points, h)
+			r.owners[h] = o
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+// Owner returns the owner responsible for value, or "" if the ring has
+// no members
+func (r *Ring) Owner(value string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	h := crc32.ChecksumIEEE([]byte(value))
+
+	idx := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if idx == len(r.points) {
+		idx = 0
+	}
+
+	return r.owners[r.points[idx]]
+}
+
+func hashKey(owner string, vnode int) uint32 {
+	return crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", owner, vnode)))
+}
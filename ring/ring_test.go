@@ -0,0 +1,74 @@
+package ring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRing_NoMembersHasNoOwner(t *testing.T) {
+	r := New()
+
+	if owner := r.Owner("anything"); owner != "" {
+		t.Fatalf("expected no owner on an empty ring, got %q", owner)
+	}
+}
+
+func TestRing_OwnerIsStableForSameMembership(t *testing.T) {
+	r := New()
+	r.Set([]string{"a", "b", "c"})
+
+	first := r.Owner("sender-1")
+	for i := 0; i < 10; i++ {
+		if got := r.Owner("sender-1"); got != first {
+			t.Fatalf("owner changed across calls with unchanged membership: %q vs %q", first, got)
+		}
+	}
+}
+
+func TestRing_MostValuesKeepTheirOwnerAfterAddingAMember(t *testing.T) {
+	r := New()
+	before := []string{"a", "b", "c", "d"}
+	r.Set(before)
+
+	values := make([]string, 1000)
+	owners := make(map[string]string, 1000)
+	for i := range values {
+		values[i] = fmt.Sprintf("value-%d", i)
+		owners[values[i]] = r.Owner(values[i])
+	}
+
+	r.Set(append(before, "e"))
+
+	moved := 0
+	for _, v := range values {
+		if r.Owner(v) != owners[v] {
+			moved++
+		}
+	}
+
+	// Consistent hashing should only remap roughly 1/len(members) of the
+	// keys when a member is added, not a large fraction of them.
+	if moved > len(values)/2 {
+		t.Fatalf("adding a member remapped %d/%d values, expected consistent hashing to remap far fewer", moved, len(values))
+	}
+}
+
+func TestRing_RemovingAMemberOnlyMovesItsOwnKeys(t *testing.T) {
+	r := New()
+	r.Set([]string{"a", "b", "c"})
+
+	values := make([]string, 500)
+	owners := make(map[string]string, 500)
+	for i := range values {
+		values[i] = fmt.Sprintf("value-%d", i)
+		owners[values[i]] = r.Owner(values[i])
+	}
+
+	r.Set([]string{"a", "b"})
+
+	for _, v := range values {
+		if owners[v] != "c" && r.Owner(v) != owners[v] {
+			t.Fatalf("value %q owned by %q moved to %q despite its owner not being removed", v, owners[v], r.Owner(v))
+		}
+	}
+}
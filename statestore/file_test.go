@@ -0,0 +1,93 @@
+package statestore
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFile_LoadOfMissingTopicReturnsEmptySnapshot(t *testing.T) {
+	f := NewFile(t.TempDir())
+
+	s, err := f.Load(context.Background(), "topic")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(s) != 0 {
+		t.Fatalf("expected an empty snapshot, got %d entries", len(s))
+	}
+}
+
+func TestFile_SaveThenLoadRoundTrips(t *testing.T) {
+	f := NewFile(t.TempDir())
+	ctx := context.Background()
+
+	now := time.Now().Round(0)
+	if err := f.Save(ctx, "topic", Snapshot{"a": now}); err != nil {
+		t.Fatalf("unexpected error saving: %s", err)
+	}
+
+	s, err := f.Load(ctx, "topic")
+	if err != nil {
+		t.Fatalf("unexpected error loading: %s", err)
+	}
+	if !s["a"].Equal(now) {
+		t.Fatalf("expected loaded entry to match what was saved, got %v want %v", s["a"], now)
+	}
+}
+
+func TestFile_SaveReplacesThePreviousSnapshot(t *testing.T) {
+	f := NewFile(t.TempDir())
+	ctx := context.Background()
+
+	if err := f.Save(ctx, "topic", Snapshot{"stale": time.Now()}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// A full Save of a snapshot that no longer includes "stale" must drop
+	// it, the way a compacted, scrubbed cache would - this is what lets a
+	// full Save reclaim space that SaveIncremental alone never can.
+	if err := f.Save(ctx, "topic", Snapshot{"fresh": time.Now()}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	s, err := f.Load(ctx, "topic")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, found := s["stale"]; found {
+		t.Fatal("expected Save to replace the previous snapshot, not merge into it")
+	}
+	if _, found := s["fresh"]; !found {
+		t.Fatal("expected the new snapshot's entry to be present")
+	}
+}
+
+// TestFile_SaveIncrementalNeverRemovesEntries is a regression test: unlike
+// Save, SaveIncremental only ever merges delta into whatever was already
+// persisted, so a key that has been scrubbed out of the in-memory cache
+// stays in the backend forever unless something eventually calls Save
+// with the compacted snapshot. This is the gap LocalLimiter.compact now
+// closes.
+func TestFile_SaveIncrementalNeverRemovesEntries(t *testing.T) {
+	f := NewFile(t.TempDir())
+	ctx := context.Background()
+
+	if err := f.SaveIncremental(ctx, "topic", Snapshot{"expired": time.Now().Add(-48 * time.Hour)}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// A scrubbed cache no longer contains "expired", but re-saving the
+	// delta for a still-live key must not remove it from the backend.
+	if err := f.SaveIncremental(ctx, "topic", Snapshot{"live": time.Now()}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	s, err := f.Load(ctx, "topic")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, found := s["expired"]; !found {
+		t.Fatal("expected SaveIncremental to leave a previously saved entry untouched, demonstrating it cannot compact on its own")
+	}
+}
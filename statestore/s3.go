@@ -0,0 +1,221 @@
+package statestore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// defaultShards is how many shards a topic's key space is partitioned
+// into when a new manifest is created
+const defaultShards = 32
+
+// manifest records how a topic's snapshot is partitioned across shard
+// objects, so Load knows how many shard objects to fetch and
+// SaveIncremental knows which shard a key belongs to
+type manifest struct {
+	Shards int `json:"shards"`
+}
+
+// S3 is a Backend that stores the last-seen cache in an S3 (or
+// S3-compatible) object store, suited to large sender fleets where a
+// single local file would be fragile and costly to rewrite in full
+// every save. The key space for each topic is partitioned across a
+// fixed number of shard objects so SaveIncremental only has to rewrite
+// the shards touched since the last save.
+type S3 struct {
+	client *s3.Client
+	bucket string
+	prefix string
+	shards int
+}
+
+// NewS3 creates an S3 backend storing objects under prefix in bucket,
+// partitioning each topic's key space into shards shard objects
+func NewS3(client *s3.Client, bucket string, prefix string, shards int) *S3 {
+	if shards <= 0 {
+		shards = defaultShards
+	}
+
+	return &S3{client: client, bucket: bucket, prefix: prefix, shards: shards}
+}
+
+func (b *S3) manifestKey(topic string) string {
+	return fmt.Sprintf("%s/%s/manifest.json", b.prefix, topic)
+}
+
+func (b *S3) shardKeyName(topic string, shard int) string {
+	return fmt.Sprintf("%s/%s/shard-%02d.json", b.prefix, topic, shard)
+}
+
+func (b *S3) shardFor(value string, shards int) int {
+	return int(crc32.ChecksumIEEE([]byte(value))) % shards
+}
+
+func (b *S3) loadManifest(ctx context.Context, topic string) (manifest, error) {
+	m := manifest{Shards: b.shards}
+
+	out, err := b.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(b.bucket), Key: aws.String(b.manifestKey(topic))})
+	if isNotFound(err) {
+		return m, nil
+	} else if err != nil {
+		return m, err
+	}
+	defer out.Body.Close()
+
+	d, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return m, err
+	}
+
+	if err := json.Unmarshal(d, &m); err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
+
+func (b *S3) saveManifest(ctx context.Context, topic string, m manifest) error {
+	d, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return b.putObject(ctx, b.manifestKey(topic), d)
+}
+
+func (b *S3) loadShard(ctx context.Context, topic string, shard int) (Snapshot, error) {
+	snapshot := make(Snapshot)
+
+	out, err := b.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(b.bucket), Key: aws.String(b.shardKeyName(topic, shard))})
+	if isNotFound(err) {
+		return snapshot, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	d, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(d, &snapshot); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+func (b *S3) putObject(ctx context.Context, key string, data []byte) error {
+	_, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(b.bucket),
+		Key:                  aws.String(key),
+		Body:                 newReadSeeker(data),
+		ServerSideEncryption: types.ServerSideEncryptionAes256,
+	})
+
+	return err
+}
+
+func (b *S3) Load(ctx context.Context, topic string) (Snapshot, error) {
+	m, err := b.loadManifest(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := make(Snapshot)
+
+	for shard := 0; shard < m.Shards; shard++ {
+		s, err := b.loadShard(ctx, topic, shard)
+		if err != nil {
+			return nil, fmt.Errorf("could not load shard %d for topic %s: %s", shard, topic, err)
+		}
+
+		for k, v := range s {
+			snapshot[k] = v
+		}
+	}
+
+	return snapshot, nil
+}
+
+func (b *S3) Save(ctx context.Context, topic string, snapshot Snapshot) error {
+	if err := b.saveManifest(ctx, topic, manifest{Shards: b.shards}); err != nil {
+		return err
+	}
+
+	byShard := make(map[int]Snapshot, b.shards)
+	for k, v := range snapshot {
+		shard := b.shardFor(k, b.shards)
+		if byShard[shard] == nil {
+			byShard[shard] = make(Snapshot)
+		}
+		byShard[shard][k] = v
+	}
+
+	for shard := 0; shard < b.shards; shard++ {
+		d, err := json.Marshal(byShard[shard])
+		if err != nil {
+			return err
+		}
+
+		if err := b.putObject(ctx, b.shardKeyName(topic, shard), d); err != nil {
+			return fmt.Errorf("could not save shard %d for topic %s: %s", shard, topic, err)
+		}
+	}
+
+	return nil
+}
+
+// SaveIncremental only rewrites the shards touched by delta, merging its
+// entries into whatever that shard already holds
+func (b *S3) SaveIncremental(ctx context.Context, topic string, delta Snapshot) error {
+	if len(delta) == 0 {
+		return nil
+	}
+
+	m, err := b.loadManifest(ctx, topic)
+	if err != nil {
+		return err
+	}
+
+	dirty := make(map[int]Snapshot)
+	for k, v := range delta {
+		shard := b.shardFor(k, m.Shards)
+		if dirty[shard] == nil {
+			dirty[shard] = make(Snapshot)
+		}
+		dirty[shard][k] = v
+	}
+
+	for shard, entries := range dirty {
+		current, err := b.loadShard(ctx, topic, shard)
+		if err != nil {
+			return fmt.Errorf("could not load shard %d for topic %s: %s", shard, topic, err)
+		}
+
+		for k, v := range entries {
+			current[k] = v
+		}
+
+		d, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+
+		if err := b.putObject(ctx, b.shardKeyName(topic, shard), d); err != nil {
+			return fmt.Errorf("could not save shard %d for topic %s: %s", shard, topic, err)
+		}
+	}
+
+	return nil
+}
+
+var _ Backend = &S3{}
@@ -0,0 +1,37 @@
+package statestore
+
+import "testing"
+
+func TestS3_ShardForIsStableAndInRange(t *testing.T) {
+	b := NewS3(nil, "bucket", "prefix", 8)
+
+	first := b.shardFor("sender-1", b.shards)
+	for i := 0; i < 10; i++ {
+		if got := b.shardFor("sender-1", b.shards); got != first {
+			t.Fatalf("shardFor is not stable for the same value: %d vs %d", first, got)
+		}
+	}
+
+	if first < 0 || first >= b.shards {
+		t.Fatalf("shard %d out of range [0,%d)", first, b.shards)
+	}
+}
+
+func TestS3_ShardKeyNamesAreTopicAndShardScoped(t *testing.T) {
+	b := NewS3(nil, "bucket", "prefix", 8)
+
+	if got, want := b.shardKeyName("topic-a", 3), "prefix/topic-a/shard-03.json"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	if got, want := b.manifestKey("topic-a"), "prefix/topic-a/manifest.json"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+func TestNewS3_DefaultsShardsWhenNotPositive(t *testing.T) {
+	b := NewS3(nil, "bucket", "prefix", 0)
+
+	if b.shards != defaultShards {
+		t.Fatalf("expected a non-positive shard count to fall back to defaultShards, got %d", b.shards)
+	}
+}
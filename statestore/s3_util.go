@@ -0,0 +1,22 @@
+package statestore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func newReadSeeker(data []byte) io.Reader {
+	return bytes.NewReader(data)
+}
+
+func isNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var nsk *types.NoSuchKey
+	return errors.As(err, &nsk)
+}
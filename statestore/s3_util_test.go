@@ -0,0 +1,28 @@
+package statestore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestIsNotFound(t *testing.T) {
+	if isNotFound(nil) {
+		t.Fatal("a nil error must not be reported as not-found")
+	}
+
+	if isNotFound(errors.New("some other failure")) {
+		t.Fatal("an unrelated error must not be reported as not-found")
+	}
+
+	if !isNotFound(&types.NoSuchKey{}) {
+		t.Fatal("a NoSuchKey error must be reported as not-found")
+	}
+
+	wrapped := fmt.Errorf("getting object: %w", &types.NoSuchKey{})
+	if !isNotFound(wrapped) {
+		t.Fatal("a wrapped NoSuchKey error must still be reported as not-found")
+	}
+}
@@ -0,0 +1,33 @@
+// Package statestore persists the last-seen cache kept by the limiter
+// backends. It abstracts over where that state actually lives so a
+// single sender can use a local file while a large fleet can use a
+// shared object store, see statestore.File and statestore.S3.
+package statestore
+
+import (
+	"context"
+	"time"
+)
+
+// Snapshot is the full last-seen state for a single topic, keyed by the
+// tracked value with the time it was last seen
+type Snapshot map[string]time.Time
+
+// Backend loads and saves the last-seen cache for a topic. Implementations
+// are expected to be safe for concurrent use by a single Limiter instance,
+// callers do not call Load concurrently with Save/SaveIncremental.
+type Backend interface {
+	// Load returns the last persisted snapshot for topic, or an empty
+	// Snapshot if none exists yet
+	Load(ctx context.Context, topic string) (Snapshot, error)
+
+	// Save persists the full snapshot for topic, replacing anything
+	// previously stored
+	Save(ctx context.Context, topic string, snapshot Snapshot) error
+
+	// SaveIncremental persists only the entries in delta, leaving the
+	// rest of the previously saved snapshot untouched. Backends that
+	// partition the key space into shards can use this to only rewrite
+	// the shards touched by delta rather than the full snapshot.
+	SaveIncremental(ctx context.Context, topic string, delta Snapshot) error
+}